@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"os"
 
 	"github.com/cyverse/overlayfs-syncher/syncher"
@@ -15,12 +16,16 @@ func main() {
 
 	logger.Logger.SetLevel(log.DebugLevel)
 
-	if len(os.Args) != 3 {
+	exportPath := flag.String("export", "", "export the upper layer as an OCI tar layer to the given path instead of syncing")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) != 2 {
 		logger.Fatalf("need two arguments, lower and upper paths")
 		os.Exit(1)
 	}
 
-	syncher, err := syncher.NewOverlayFSSyncher(os.Args[1], os.Args[2])
+	syncher, err := syncher.NewOverlayFSSyncher(args[0], args[1])
 	if err != nil {
 		logger.Fatalf("%+v", err)
 		os.Exit(1)
@@ -28,6 +33,23 @@ func main() {
 
 	//syncher.SetDryRun(true)
 
+	if *exportPath != "" {
+		out, err := os.Create(*exportPath)
+		if err != nil {
+			logger.Fatalf("%+v", err)
+			os.Exit(1)
+		}
+		defer out.Close()
+
+		err = syncher.Export(out)
+		if err != nil {
+			logger.Fatalf("%+v", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	err = syncher.Sync()
 	if err != nil {
 		logger.Fatalf("%+v", err)
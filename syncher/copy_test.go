@@ -0,0 +1,87 @@
+package syncher
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyFileContentsFallsBackToUserspaceCopy(t *testing.T) {
+	dir := t.TempDir()
+
+	data := bytes.Repeat([]byte("overlayfs-syncher"), 1024)
+
+	srcPath := filepath.Join(dir, "src")
+	if err := os.WriteFile(srcPath, data, 0o644); err != nil {
+		t.Fatalf("failed to create src file: %s", err)
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		t.Fatalf("failed to open src file: %s", err)
+	}
+	defer src.Close()
+
+	destPath := filepath.Join(dir, "dest")
+	dest, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		t.Fatalf("failed to create dest file: %s", err)
+	}
+	defer dest.Close()
+
+	syncher := &OverlayFSSyncher{copyStrategy: CopyUserspace}
+	if err := syncher.copyFileContents(src, dest); err != nil {
+		t.Fatalf("copyFileContents failed: %s", err)
+	}
+
+	got, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("failed to read dest file: %s", err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected dest contents to match src contents")
+	}
+}
+
+func TestCopyFileContentsReflinkStrategyStillCopies(t *testing.T) {
+	dir := t.TempDir()
+
+	data := []byte("reflink or fall back, the bytes must still arrive")
+
+	srcPath := filepath.Join(dir, "src")
+	if err := os.WriteFile(srcPath, data, 0o644); err != nil {
+		t.Fatalf("failed to create src file: %s", err)
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		t.Fatalf("failed to open src file: %s", err)
+	}
+	defer src.Close()
+
+	destPath := filepath.Join(dir, "dest")
+	dest, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		t.Fatalf("failed to create dest file: %s", err)
+	}
+	defer dest.Close()
+
+	// default zero value is CopyReflink; on a filesystem that doesn't
+	// support FICLONE or copy_file_range (e.g. tmpfs in CI), this exercises
+	// the fallback chain down to the userspace io.Copy.
+	syncher := &OverlayFSSyncher{}
+	if err := syncher.copyFileContents(src, dest); err != nil {
+		t.Fatalf("copyFileContents failed: %s", err)
+	}
+
+	got, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("failed to read dest file: %s", err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected dest contents to match src contents")
+	}
+}
@@ -0,0 +1,325 @@
+package syncher
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/xattr"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+const (
+	ociWhiteoutPrefix     string = ".wh."
+	ociWhiteoutOpaqueName string = ".wh..wh..opq"
+)
+
+// Export streams the upper layer as an OCI/Docker image layer tar archive,
+// converting overlayfs whiteouts into AUFS-style whiteout markers so that
+// the resulting tar can be pushed to a registry or fed to buildah/podman.
+func (syncher *OverlayFSSyncher) Export(w io.Writer) error {
+	logger := log.WithFields(log.Fields{
+		"package":  "syncher",
+		"function": "Export",
+	})
+
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	walkFunc := func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return xerrors.Errorf("failed to walk %s: %w", path, err)
+		}
+
+		if path == syncher.upperLayerPath {
+			// skip root
+			return nil
+		}
+
+		relpath, relErr := filepath.Rel(syncher.upperLayerPath, path)
+		if relErr != nil {
+			return xerrors.Errorf("failed to get relative path from %s to %s: %w", syncher.upperLayerPath, path, relErr)
+		}
+
+		if d.IsDir() {
+			return syncher.exportDir(tw, path, relpath)
+		}
+
+		if d.Type()&os.ModeCharDevice != 0 {
+			whiteout, wErr := isWhiteoutDevice(path)
+			if wErr != nil {
+				return wErr
+			}
+
+			if whiteout {
+				return syncher.exportWhiteout(tw, path, relpath)
+			}
+		}
+
+		return syncher.exportFile(tw, path, relpath, d)
+	}
+
+	logger.Debugf("exporting upper layer %s", syncher.upperLayerPath)
+
+	err := filepath.WalkDir(syncher.upperLayerPath, walkFunc)
+	if err != nil {
+		return xerrors.Errorf("failed to walk dir %s: %w", syncher.upperLayerPath, err)
+	}
+
+	return nil
+}
+
+func (syncher *OverlayFSSyncher) exportDir(tw *tar.Writer, path string, relpath string) error {
+	logger := log.WithFields(log.Fields{
+		"package":  "syncher",
+		"function": "exportDir",
+	})
+
+	logger.Debugf("exporting dir %s", path)
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return xerrors.Errorf("failed to lstat %s: %w", path, err)
+	}
+
+	header, err := tarHeader(path, relpath+"/", info, false)
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return xerrors.Errorf("failed to write tar header for %s: %w", relpath, err)
+	}
+
+	opaqueDir := false
+	xattrVal, err := xattr.Get(path, overlayFSOpaqueXAttr)
+	if err == nil && string(xattrVal) == "y" {
+		opaqueDir = true
+	}
+
+	if opaqueDir {
+		opaquePath := filepath.Join(relpath, ociWhiteoutOpaqueName)
+
+		logger.Debugf("writing opaque marker %s", opaquePath)
+
+		opaqueHeader := &tar.Header{
+			Name:     opaquePath,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Uid:      header.Uid,
+			Gid:      header.Gid,
+			ModTime:  header.ModTime,
+		}
+
+		if err := tw.WriteHeader(opaqueHeader); err != nil {
+			return xerrors.Errorf("failed to write tar header for %s: %w", opaquePath, err)
+		}
+	}
+
+	return nil
+}
+
+// isWhiteoutDevice reports whether path is an overlayfs whiteout marker: a
+// character device with major/minor 0/0. Any other char device (e.g. one
+// intentionally mknod'd into the upper layer for an image build) is a real
+// device node, not a whiteout.
+func isWhiteoutDevice(path string) (bool, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false, xerrors.Errorf("failed to lstat %s: %w", path, err)
+	}
+
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false, nil
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, xerrors.Errorf("failed to get stat_t for %s", path)
+	}
+
+	return stat.Rdev == 0, nil
+}
+
+func (syncher *OverlayFSSyncher) exportWhiteout(tw *tar.Writer, path string, relpath string) error {
+	logger := log.WithFields(log.Fields{
+		"package":  "syncher",
+		"function": "exportWhiteout",
+	})
+
+	whiteoutPath := filepath.Join(filepath.Dir(relpath), ociWhiteoutPrefix+filepath.Base(relpath))
+
+	logger.Debugf("exporting whiteout %s as %s", path, whiteoutPath)
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return xerrors.Errorf("failed to lstat %s: %w", path, err)
+	}
+
+	header := &tar.Header{
+		Name:     whiteoutPath,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		ModTime:  info.ModTime(),
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		header.Uid = int(stat.Uid)
+		header.Gid = int(stat.Gid)
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return xerrors.Errorf("failed to write tar header for %s: %w", whiteoutPath, err)
+	}
+
+	return nil
+}
+
+func (syncher *OverlayFSSyncher) exportFile(tw *tar.Writer, path string, relpath string, d fs.DirEntry) error {
+	logger := log.WithFields(log.Fields{
+		"package":  "syncher",
+		"function": "exportFile",
+	})
+
+	logger.Debugf("exporting file %s", path)
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return xerrors.Errorf("failed to lstat %s: %w", path, err)
+	}
+
+	if d.Type()&os.ModeSymlink != 0 {
+		linkTarget, err := os.Readlink(path)
+		if err != nil {
+			return xerrors.Errorf("failed to readlink %s: %w", path, err)
+		}
+
+		header, err := tarHeader(path, relpath, info, true)
+		if err != nil {
+			return err
+		}
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = linkTarget
+
+		if err := tw.WriteHeader(header); err != nil {
+			return xerrors.Errorf("failed to write tar header for %s: %w", relpath, err)
+		}
+
+		return nil
+	}
+
+	if info.Mode()&os.ModeDevice != 0 {
+		return syncher.exportDevice(tw, path, relpath, info)
+	}
+
+	header, err := tarHeader(path, relpath, info, false)
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return xerrors.Errorf("failed to write tar header for %s: %w", relpath, err)
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return xerrors.Errorf("failed to open %s: %w", path, err)
+	}
+	defer src.Close()
+
+	if _, err := io.Copy(tw, src); err != nil {
+		return xerrors.Errorf("failed to write %s to tar: %w", relpath, err)
+	}
+
+	return nil
+}
+
+// exportDevice writes a tar entry for a real (non-whiteout) char or block
+// device node, preserving its major/minor numbers.
+func (syncher *OverlayFSSyncher) exportDevice(tw *tar.Writer, path string, relpath string, info os.FileInfo) error {
+	header, err := tarHeader(path, relpath, info, false)
+	if err != nil {
+		return err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return xerrors.Errorf("failed to get stat_t for %s", path)
+	}
+
+	if info.Mode()&os.ModeCharDevice != 0 {
+		header.Typeflag = tar.TypeChar
+	} else {
+		header.Typeflag = tar.TypeBlock
+	}
+	header.Devmajor = int64(unix.Major(uint64(stat.Rdev)))
+	header.Devminor = int64(unix.Minor(uint64(stat.Rdev)))
+	header.Size = 0
+
+	if err := tw.WriteHeader(header); err != nil {
+		return xerrors.Errorf("failed to write tar header for %s: %w", relpath, err)
+	}
+
+	return nil
+}
+
+// tarHeader builds a tar header for path from its stat info, including
+// uid/gid/mtime and any user/security/trusted xattrs (other than the
+// overlayfs-internal ones), so regular files and directories round-trip
+// their real ownership and metadata through the exported layer. Pass
+// symlink true for a symlink entry so xattrs are read with the L-variants
+// instead of following the (possibly dangling) link target.
+func tarHeader(path string, name string, info os.FileInfo, symlink bool) (*tar.Header, error) {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return nil, xerrors.Errorf("failed to build tar header for %s: %w", path, err)
+	}
+
+	header.Name = name
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		header.Uid = int(stat.Uid)
+		header.Gid = int(stat.Gid)
+	}
+
+	list := xattr.List
+	get := xattr.Get
+	if symlink {
+		list = xattr.LList
+		get = xattr.LGet
+	}
+
+	xattrNames, err := list(path)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to list xattrs for %s: %w", path, err)
+	}
+
+	for _, name := range xattrNames {
+		if isOverlayXAttr(name) {
+			continue
+		}
+
+		val, err := get(path, name)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to get xattr %s for %s: %w", name, path, err)
+		}
+
+		if header.PAXRecords == nil {
+			header.PAXRecords = map[string]string{}
+		}
+		header.PAXRecords[fmt.Sprintf("SCHILY.xattr.%s", name)] = string(val)
+	}
+
+	return header, nil
+}
+
+func isOverlayXAttr(name string) bool {
+	return strings.HasPrefix(name, "trusted.overlay.")
+}
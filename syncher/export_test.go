@@ -0,0 +1,90 @@
+package syncher
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestIsWhiteoutDeviceDetectsZeroZero(t *testing.T) {
+	dir := t.TempDir()
+
+	whiteoutPath := filepath.Join(dir, "whiteout")
+	if err := syscall.Mknod(whiteoutPath, syscall.S_IFCHR|0o644, 0); err != nil {
+		t.Skipf("mknod not permitted in this environment: %s", err)
+	}
+
+	whiteout, err := isWhiteoutDevice(whiteoutPath)
+	if err != nil {
+		t.Fatalf("isWhiteoutDevice failed: %s", err)
+	}
+	if !whiteout {
+		t.Fatalf("expected 0/0 char device to be detected as a whiteout")
+	}
+}
+
+func TestIsWhiteoutDeviceIgnoresRealDevice(t *testing.T) {
+	dir := t.TempDir()
+
+	devPath := filepath.Join(dir, "device")
+	// major 1, minor 5 is /dev/zero on Linux; any non-zero rdev exercises the fix.
+	rdev := int(unix.Mkdev(1, 5))
+	if err := syscall.Mknod(devPath, syscall.S_IFCHR|0o644, rdev); err != nil {
+		t.Skipf("mknod not permitted in this environment: %s", err)
+	}
+
+	whiteout, err := isWhiteoutDevice(devPath)
+	if err != nil {
+		t.Fatalf("isWhiteoutDevice failed: %s", err)
+	}
+	if whiteout {
+		t.Fatalf("expected a real device node to not be detected as a whiteout")
+	}
+}
+
+func TestExportHandlesDanglingSymlink(t *testing.T) {
+	upper := t.TempDir()
+	lower := t.TempDir()
+
+	linkPath := filepath.Join(upper, "dangling")
+	if err := os.Symlink(filepath.Join(upper, "does-not-exist"), linkPath); err != nil {
+		t.Fatalf("failed to create symlink: %s", err)
+	}
+
+	syncher, err := NewOverlayFSSyncher(lower, upper)
+	if err != nil {
+		t.Fatalf("failed to create syncher: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := syncher.Export(&buf); err != nil {
+		t.Fatalf("Export failed on a dangling symlink: %s", err)
+	}
+
+	tr := tar.NewReader(&buf)
+	var found bool
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read tar entry: %s", err)
+		}
+		if header.Name == "dangling" {
+			found = true
+			if header.Typeflag != tar.TypeSymlink {
+				t.Fatalf("expected dangling entry to be a symlink, got typeflag %c", header.Typeflag)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("expected exported tar to contain the dangling symlink")
+	}
+}
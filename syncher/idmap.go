@@ -0,0 +1,95 @@
+package syncher
+
+import (
+	"fmt"
+)
+
+// IDMapping maps a contiguous range of container ids to host ids, mirroring
+// the format used by /proc/<pid>/uid_map and gid_map for user namespaces.
+type IDMapping struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// IDMap holds the uid and gid mappings for a user-namespaced upper layer
+// (e.g. rootless podman/buildah), so ids recorded there can be translated
+// to host ids (or another target mapping) before being written to the
+// lower layer.
+type IDMap struct {
+	UIDMap []IDMapping
+	GIDMap []IDMapping
+}
+
+// IDNotMappedError is returned when an id falls outside every range of a
+// configured mapping, so callers can decide whether to skip or abort.
+type IDNotMappedError struct {
+	ID int
+}
+
+func (e *IDNotMappedError) Error() string {
+	return fmt.Sprintf("id %d is not covered by any configured id mapping range", e.ID)
+}
+
+// SetIDMap sets the uid/gid mapping applied to ownership before it is
+// written to the lower layer. The zero value (no mappings) leaves ids
+// untranslated.
+func (syncher *OverlayFSSyncher) SetIDMap(m IDMap) {
+	syncher.idMap = m
+}
+
+// Invert swaps ContainerID and HostID in every mapping, so the same IDMap
+// can also drive the opposite (unpack) direction.
+func (m IDMap) Invert() IDMap {
+	return IDMap{
+		UIDMap: invertMappings(m.UIDMap),
+		GIDMap: invertMappings(m.GIDMap),
+	}
+}
+
+func invertMappings(mappings []IDMapping) []IDMapping {
+	if mappings == nil {
+		return nil
+	}
+
+	inverted := make([]IDMapping, len(mappings))
+	for i, mapping := range mappings {
+		inverted[i] = IDMapping{ContainerID: mapping.HostID, HostID: mapping.ContainerID, Size: mapping.Size}
+	}
+
+	return inverted
+}
+
+// ToHost translates a container id to a host id using mappings, doing a
+// linear scan of the configured ranges. If mappings is empty, id is
+// returned unchanged.
+func ToHost(mappings []IDMapping, id int) (int, error) {
+	if len(mappings) == 0 {
+		return id, nil
+	}
+
+	for _, mapping := range mappings {
+		if id >= mapping.ContainerID && id < mapping.ContainerID+mapping.Size {
+			return mapping.HostID + (id - mapping.ContainerID), nil
+		}
+	}
+
+	return 0, &IDNotMappedError{ID: id}
+}
+
+// ToContainer translates a host id to a container id using mappings, doing
+// a linear scan of the configured ranges. If mappings is empty, id is
+// returned unchanged.
+func ToContainer(mappings []IDMapping, id int) (int, error) {
+	if len(mappings) == 0 {
+		return id, nil
+	}
+
+	for _, mapping := range mappings {
+		if id >= mapping.HostID && id < mapping.HostID+mapping.Size {
+			return mapping.ContainerID + (id - mapping.HostID), nil
+		}
+	}
+
+	return 0, &IDNotMappedError{ID: id}
+}
@@ -0,0 +1,74 @@
+package syncher
+
+import "testing"
+
+func TestToHost(t *testing.T) {
+	mappings := []IDMapping{
+		{ContainerID: 0, HostID: 100000, Size: 65536},
+	}
+
+	got, err := ToHost(mappings, 1000)
+	if err != nil {
+		t.Fatalf("ToHost failed: %s", err)
+	}
+	if want := 101000; got != want {
+		t.Fatalf("expected %d, got %d", want, got)
+	}
+
+	if _, err := ToHost(mappings, 70000); err == nil {
+		t.Fatalf("expected an error for an id outside every mapped range")
+	}
+}
+
+func TestToHostNoMappingsIsIdentity(t *testing.T) {
+	got, err := ToHost(nil, 1000)
+	if err != nil {
+		t.Fatalf("ToHost failed: %s", err)
+	}
+	if got != 1000 {
+		t.Fatalf("expected unmapped id to pass through unchanged, got %d", got)
+	}
+}
+
+func TestToContainer(t *testing.T) {
+	mappings := []IDMapping{
+		{ContainerID: 0, HostID: 100000, Size: 65536},
+	}
+
+	got, err := ToContainer(mappings, 101000)
+	if err != nil {
+		t.Fatalf("ToContainer failed: %s", err)
+	}
+	if want := 1000; got != want {
+		t.Fatalf("expected %d, got %d", want, got)
+	}
+
+	if _, err := ToContainer(mappings, 50); err == nil {
+		t.Fatalf("expected an error for a host id outside every mapped range")
+	}
+}
+
+func TestIDMapInvert(t *testing.T) {
+	m := IDMap{
+		UIDMap: []IDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		GIDMap: []IDMapping{{ContainerID: 0, HostID: 200000, Size: 65536}},
+	}
+
+	inverted := m.Invert()
+
+	uid, err := ToHost(inverted.UIDMap, 100000)
+	if err != nil {
+		t.Fatalf("ToHost on inverted map failed: %s", err)
+	}
+	if uid != 0 {
+		t.Fatalf("expected inverted uid map to send host id 100000 back to container id 0, got %d", uid)
+	}
+
+	gid, err := ToHost(inverted.GIDMap, 200000)
+	if err != nil {
+		t.Fatalf("ToHost on inverted map failed: %s", err)
+	}
+	if gid != 0 {
+		t.Fatalf("expected inverted gid map to send host id 200000 back to container id 0, got %d", gid)
+	}
+}
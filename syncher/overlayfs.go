@@ -1,25 +1,35 @@
 package syncher
 
 import (
-	"io"
+	"context"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pkg/xattr"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sys/unix"
 	"golang.org/x/xerrors"
 )
 
 const (
-	overlayFSOpaqueXAttr string = "trusted.overlay.opaque"
+	overlayFSOpaqueXAttr   string = "trusted.overlay.opaque"
+	overlayFSRedirectXAttr string = "trusted.overlay.redirect"
+	overlayFSMetacopyXAttr string = "trusted.overlay.metacopy"
 )
 
 type OverlayFSSyncher struct {
 	lowerLayerPath string
 	upperLayerPath string
 	dryrun         bool
+	concurrency    int
+	copyStrategy   CopyStrategy
+	idMap          IDMap
 }
 
 // NewOverlayFSSyncher creates a new OverlayFSSyncher
@@ -37,6 +47,7 @@ func NewOverlayFSSyncher(lower string, upper string) (*OverlayFSSyncher, error)
 	return &OverlayFSSyncher{
 		lowerLayerPath: absLower,
 		upperLayerPath: absUpper,
+		concurrency:    runtime.NumCPU(),
 	}, nil
 }
 
@@ -55,8 +66,40 @@ func (syncher *OverlayFSSyncher) SetDryRun(dryrun bool) {
 	syncher.dryrun = dryrun
 }
 
-// Sync syncs upper layer data to lower layer
+// SetConcurrency sets the number of worker goroutines used to sync files
+// and whiteouts. Defaults to runtime.NumCPU(). Values below 1 are clamped
+// to 1.
+func (syncher *OverlayFSSyncher) SetConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+
+	syncher.concurrency = n
+}
+
+// syncTask describes a single file or whiteout operation to be handed to
+// a worker goroutine.
+type syncTask struct {
+	path     string
+	whiteout bool
+	device   bool
+	symlink  bool
+}
+
+// Sync syncs upper layer data to lower layer. Directories are created and
+// merged serially on the walking goroutine, in the parent-before-child
+// order filepath.WalkDir already guarantees, so that no worker ever races
+// to write into a directory that doesn't exist on the lower layer yet.
+// Files and whiteouts are collected during the walk and then fanned out
+// to a pool of worker goroutines.
 func (syncher *OverlayFSSyncher) Sync() error {
+	logger := log.WithFields(log.Fields{
+		"package":  "syncher",
+		"function": "Sync",
+	})
+
+	var tasks []syncTask
+
 	walkFunc := func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return xerrors.Errorf("failed to walk %s: %w", path, err)
@@ -68,24 +111,34 @@ func (syncher *OverlayFSSyncher) Sync() error {
 				return nil
 			}
 
-			syncErr := syncher.syncDir(path)
-			if syncErr != nil {
-				return syncErr
+			return syncher.syncDir(path)
+		}
+
+		task := syncTask{
+			path:    path,
+			symlink: d.Type()&os.ModeSymlink != 0,
+		}
+
+		if d.Type()&os.ModeCharDevice != 0 {
+			// overlayfs whiteouts are always 0/0 char devices; block
+			// devices can never be whiteouts, so only char devices need
+			// the extra check.
+			whiteout, wErr := isWhiteoutDevice(path)
+			if wErr != nil {
+				return wErr
 			}
-		} else {
-			// file
-			if d.Type()&os.ModeCharDevice != 0 {
-				syncErr := syncher.syncWhiteout(path)
-				if syncErr != nil {
-					return syncErr
-				}
+
+			if whiteout {
+				task.whiteout = true
 			} else {
-				syncErr := syncher.syncFile(path)
-				if syncErr != nil {
-					return syncErr
-				}
+				task.device = true
 			}
+		} else if d.Type()&os.ModeDevice != 0 {
+			// block device
+			task.device = true
 		}
+
+		tasks = append(tasks, task)
 		return nil
 	}
 
@@ -94,7 +147,71 @@ func (syncher *OverlayFSSyncher) Sync() error {
 		return xerrors.Errorf("failed to walk dir %s: %w", syncher.upperLayerPath, err)
 	}
 
-	return nil
+	logger.Debugf("syncing %d files and whiteouts with %d workers", len(tasks), syncher.concurrency)
+
+	return syncher.runTasks(tasks)
+}
+
+// runTasks fans tasks out to syncher.concurrency worker goroutines over a
+// channel. Any worker error cancels the shared context so the remaining
+// workers and the feeder stop early, and the first error is returned.
+func (syncher *OverlayFSSyncher) runTasks(tasks []syncTask) error {
+	group, groupCtx := errgroup.WithContext(context.Background())
+	taskCh := make(chan syncTask)
+
+	for i := 0; i < syncher.concurrency; i++ {
+		workerID := i
+
+		group.Go(func() error {
+			logger := log.WithFields(log.Fields{
+				"package":  "syncher",
+				"function": "Sync",
+				"worker":   workerID,
+			})
+
+			for {
+				select {
+				case <-groupCtx.Done():
+					return groupCtx.Err()
+				case task, ok := <-taskCh:
+					if !ok {
+						return nil
+					}
+
+					if err := syncher.runTask(logger, task); err != nil {
+						return err
+					}
+				}
+			}
+		})
+	}
+
+feed:
+	for _, task := range tasks {
+		select {
+		case <-groupCtx.Done():
+			break feed
+		case taskCh <- task:
+		}
+	}
+	close(taskCh)
+
+	return group.Wait()
+}
+
+func (syncher *OverlayFSSyncher) runTask(logger *log.Entry, task syncTask) error {
+	if task.whiteout {
+		logger.Debugf("picked up whiteout task %s", task.path)
+		return syncher.syncWhiteout(task.path)
+	}
+
+	if task.device {
+		logger.Debugf("picked up device task %s", task.path)
+		return syncher.syncDevice(task.path)
+	}
+
+	logger.Debugf("picked up file task %s", task.path)
+	return syncher.syncFile(task.path, task.symlink)
 }
 
 func (syncher *OverlayFSSyncher) getLowerLayerPath(path string) (string, error) {
@@ -103,11 +220,42 @@ func (syncher *OverlayFSSyncher) getLowerLayerPath(path string) (string, error)
 		return "", xerrors.Errorf("failed to get relative path from %s to %s", syncher.upperLayerPath, path)
 	}
 
-	lowerPath := filepath.Join(syncher.lowerLayerPath, relpath)
+	lowerPath, err := secureJoin(syncher.lowerLayerPath, relpath)
+	if err != nil {
+		return "", xerrors.Errorf("failed to resolve lower path for %s: %w", relpath, err)
+	}
 
 	return lowerPath, nil
 }
 
+// resolveRedirect reads the trusted.overlay.redirect xattr off an upper
+// layer directory and resolves it to a lower layer path. Per the overlayfs
+// kernel docs, an absolute value is rooted at the lower layer, while a
+// relative value is resolved against the directory's lower parent. Returns
+// "" if the xattr is not set.
+func (syncher *OverlayFSSyncher) resolveRedirect(path string, lowerPath string) (string, error) {
+	xattrVal, err := xattr.Get(path, overlayFSRedirectXAttr)
+	if err != nil {
+		return "", nil
+	}
+
+	redirect := string(xattrVal)
+	if redirect == "" {
+		return "", nil
+	}
+
+	if filepath.IsAbs(redirect) {
+		return secureJoin(syncher.lowerLayerPath, redirect)
+	}
+
+	relToParent, err := filepath.Rel(syncher.lowerLayerPath, filepath.Dir(lowerPath))
+	if err != nil {
+		return "", xerrors.Errorf("failed to get relative path from %s to %s: %w", syncher.lowerLayerPath, filepath.Dir(lowerPath), err)
+	}
+
+	return secureJoin(syncher.lowerLayerPath, filepath.Join(relToParent, redirect))
+}
+
 func (syncher *OverlayFSSyncher) syncWhiteout(path string) error {
 	logger := log.WithFields(log.Fields{
 		"package":  "syncher",
@@ -146,7 +294,59 @@ func (syncher *OverlayFSSyncher) syncWhiteout(path string) error {
 	return nil
 }
 
-func (syncher *OverlayFSSyncher) syncFile(path string) error {
+// syncDevice recreates a real (non-whiteout) char or block device node on
+// the lower layer, preserving its major/minor numbers and metadata.
+func (syncher *OverlayFSSyncher) syncDevice(path string) error {
+	logger := log.WithFields(log.Fields{
+		"package":  "syncher",
+		"function": "syncDevice",
+	})
+
+	logger.Debugf("processing device node %s", path)
+
+	lowerPath, err := syncher.getLowerLayerPath(path)
+	if err != nil {
+		return err
+	}
+
+	srcInfo, err := os.Lstat(path)
+	if err != nil {
+		return xerrors.Errorf("failed to lstat %s: %w", path, err)
+	}
+
+	stat, ok := srcInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return xerrors.Errorf("failed to get stat_t for %s", path)
+	}
+
+	if _, err := os.Lstat(lowerPath); err == nil {
+		logger.Debugf("deleting %s", lowerPath)
+
+		if !syncher.dryrun {
+			if err := os.RemoveAll(lowerPath); err != nil {
+				return xerrors.Errorf("failed to remove %s: %w", lowerPath, err)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return xerrors.Errorf("failed to stat %s: %w", lowerPath, err)
+	}
+
+	logger.Debugf("creating device node %s", lowerPath)
+
+	if !syncher.dryrun {
+		if err := unix.Mknod(lowerPath, stat.Mode, int(stat.Rdev)); err != nil {
+			return xerrors.Errorf("failed to mknod %s: %w", lowerPath, err)
+		}
+
+		if err := syncher.applyMetadata(path, lowerPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (syncher *OverlayFSSyncher) syncFile(path string, isSymlink bool) error {
 	logger := log.WithFields(log.Fields{
 		"package":  "syncher",
 		"function": "syncFile",
@@ -159,28 +359,78 @@ func (syncher *OverlayFSSyncher) syncFile(path string) error {
 		return err
 	}
 
-	lowerEntry, err := os.Stat(lowerPath)
+	if !isSymlink {
+		if _, metacopyErr := xattr.Get(path, overlayFSMetacopyXAttr); metacopyErr == nil {
+			upperInfo, statErr := os.Stat(path)
+			if statErr != nil {
+				return xerrors.Errorf("failed to stat %s: %w", path, statErr)
+			}
+
+			if upperInfo.Size() == 0 {
+				// metacopy: the real content already lives in the lower layer,
+				// only metadata changed upstairs, so don't truncate it away.
+				logger.Debugf("metacopy file %s, updating metadata only", lowerPath)
+
+				if !syncher.dryrun {
+					if _, err := os.Lstat(lowerPath); err != nil {
+						return xerrors.Errorf("metacopy file %s has no lower counterpart: %w", lowerPath, err)
+					}
+
+					if err := syncher.applyMetadata(path, lowerPath); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			}
+		}
+	}
+
+	lowerEntry, err := os.Lstat(lowerPath)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return xerrors.Errorf("failed to stat %s: %w", lowerPath, err)
 		}
 	} else {
 		// exist
-		// if it is a dir, remove first
-		// if it is a file, overwrite
-		logger.Debugf("deleting dir %s", lowerPath)
+		// remove it regardless of type, it will be recreated below
+		logger.Debugf("deleting %s", lowerPath)
 
 		if !syncher.dryrun {
 			if lowerEntry.IsDir() {
-				// remove dir first
 				err = os.RemoveAll(lowerPath)
-				if err != nil {
-					return xerrors.Errorf("failed to remove %s: %w", lowerPath, err)
-				}
+			} else {
+				err = os.Remove(lowerPath)
+			}
+
+			if err != nil {
+				return xerrors.Errorf("failed to remove %s: %w", lowerPath, err)
 			}
 		}
 	}
 
+	if isSymlink {
+		logger.Debugf("creating symlink %s", lowerPath)
+
+		if !syncher.dryrun {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return xerrors.Errorf("failed to readlink %s: %w", path, err)
+			}
+
+			err = os.Symlink(target, lowerPath)
+			if err != nil {
+				return xerrors.Errorf("failed to symlink %s to %s: %w", lowerPath, target, err)
+			}
+
+			if err := syncher.applySymlinkMetadata(path, lowerPath); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
 	logger.Debugf("copying file %s", lowerPath)
 
 	if !syncher.dryrun {
@@ -195,11 +445,16 @@ func (syncher *OverlayFSSyncher) syncFile(path string) error {
 		if err != nil {
 			return xerrors.Errorf("failed to open %s: %w", lowerPath, err)
 		}
-		defer dest.Close()
 
-		_, err = io.Copy(dest, src)
+		err = syncher.copyFileContents(src, dest)
 		if err != nil {
-			return xerrors.Errorf("failed to copy %s to %s: %w", path, lowerPath, err)
+			dest.Close()
+			return err
+		}
+		dest.Close()
+
+		if err := syncher.applyMetadata(path, lowerPath); err != nil {
+			return err
 		}
 
 		return nil
@@ -221,6 +476,29 @@ func (syncher *OverlayFSSyncher) syncDir(path string) error {
 		return err
 	}
 
+	redirectLowerPath, err := syncher.resolveRedirect(path, lowerPath)
+	if err != nil {
+		return err
+	}
+
+	if redirectLowerPath != "" && redirectLowerPath != lowerPath {
+		if _, statErr := os.Lstat(redirectLowerPath); statErr == nil {
+			logger.Debugf("moving redirected dir %s to %s", redirectLowerPath, lowerPath)
+
+			if !syncher.dryrun {
+				if err := os.MkdirAll(filepath.Dir(lowerPath), 0o700); err != nil {
+					return xerrors.Errorf("failed to make parent dir for %s: %w", lowerPath, err)
+				}
+
+				if err := os.Rename(redirectLowerPath, lowerPath); err != nil {
+					return xerrors.Errorf("failed to move redirected dir %s to %s: %w", redirectLowerPath, lowerPath, err)
+				}
+			}
+		} else if !os.IsNotExist(statErr) {
+			return xerrors.Errorf("failed to stat redirect source %s: %w", redirectLowerPath, statErr)
+		}
+	}
+
 	opaqueDir := false
 	xattrVal, err := xattr.Get(path, overlayFSOpaqueXAttr)
 	if err == nil {
@@ -243,6 +521,10 @@ func (syncher *OverlayFSSyncher) syncDir(path string) error {
 				if err != nil {
 					return xerrors.Errorf("failed to make dir %s: %w", lowerPath, err)
 				}
+
+				if err := syncher.applyMetadata(path, lowerPath); err != nil {
+					return err
+				}
 			}
 
 			return nil
@@ -272,6 +554,10 @@ func (syncher *OverlayFSSyncher) syncDir(path string) error {
 			if err != nil {
 				return xerrors.Errorf("failed to make dir %s: %w", lowerPath, err)
 			}
+
+			if err := syncher.applyMetadata(path, lowerPath); err != nil {
+				return err
+			}
 		}
 
 		return nil
@@ -293,6 +579,139 @@ func (syncher *OverlayFSSyncher) syncDir(path string) error {
 		logger.Debugf("merging dir %s", lowerPath)
 	}
 
+	if !syncher.dryrun {
+		if err := syncher.applyMetadata(path, lowerPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mapOwnership translates a container uid/gid pair to the host ids using
+// syncher's configured IDMap, so ownership recorded inside a user namespace
+// is written to the lower layer as the host ids that can actually access it.
+func (syncher *OverlayFSSyncher) mapOwnership(uid int, gid int) (int, int, error) {
+	hostUID, err := ToHost(syncher.idMap.UIDMap, uid)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	hostGID, err := ToHost(syncher.idMap.GIDMap, gid)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return hostUID, hostGID, nil
+}
+
+// applyMetadata replays the source's mode, ownership, mtime/atime, and
+// user/security/trusted xattrs (other than the overlayfs-internal ones)
+// onto the destination so the lower layer matches the merged view after
+// sync. destPath must already exist as a regular file or directory.
+func (syncher *OverlayFSSyncher) applyMetadata(srcPath string, destPath string) error {
+	srcInfo, err := os.Lstat(srcPath)
+	if err != nil {
+		return xerrors.Errorf("failed to lstat %s: %w", srcPath, err)
+	}
+
+	stat, ok := srcInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return xerrors.Errorf("failed to get stat_t for %s", srcPath)
+	}
+
+	uid, gid, err := syncher.mapOwnership(int(stat.Uid), int(stat.Gid))
+	if err != nil {
+		return xerrors.Errorf("failed to map ownership of %s: %w", srcPath, err)
+	}
+
+	// chown before chmod: on Linux, chown clears the setuid/setgid bits
+	// (unless the process holds CAP_FSETID), so chmod-ing the full mode
+	// must happen last or those bits are silently lost.
+	if err := os.Chown(destPath, uid, gid); err != nil {
+		return xerrors.Errorf("failed to chown %s: %w", destPath, err)
+	}
+
+	if err := os.Chmod(destPath, srcInfo.Mode()); err != nil {
+		return xerrors.Errorf("failed to chmod %s: %w", destPath, err)
+	}
+
+	atime := time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
+	mtime := time.Unix(stat.Mtim.Sec, stat.Mtim.Nsec)
+	if err := os.Chtimes(destPath, atime, mtime); err != nil {
+		return xerrors.Errorf("failed to chtimes %s: %w", destPath, err)
+	}
+
+	if err := copyXAttrs(srcPath, destPath, false); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// applySymlinkMetadata replays ownership and xattrs onto a symlink. Mode
+// and timestamps are not replayed since symlinks carry no meaningful
+// permissions and the standard library has no lutimes equivalent.
+func (syncher *OverlayFSSyncher) applySymlinkMetadata(srcPath string, destPath string) error {
+	srcInfo, err := os.Lstat(srcPath)
+	if err != nil {
+		return xerrors.Errorf("failed to lstat %s: %w", srcPath, err)
+	}
+
+	stat, ok := srcInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return xerrors.Errorf("failed to get stat_t for %s", srcPath)
+	}
+
+	uid, gid, err := syncher.mapOwnership(int(stat.Uid), int(stat.Gid))
+	if err != nil {
+		return xerrors.Errorf("failed to map ownership of %s: %w", srcPath, err)
+	}
+
+	if err := os.Lchown(destPath, uid, gid); err != nil {
+		return xerrors.Errorf("failed to lchown %s: %w", destPath, err)
+	}
+
+	if err := copyXAttrs(srcPath, destPath, true); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// copyXAttrs enumerates the user/security/trusted xattrs on srcPath and
+// replays them on destPath, skipping trusted.overlay.* xattrs which are
+// overlayfs-internal bookkeeping rather than file metadata.
+func copyXAttrs(srcPath string, destPath string, symlink bool) error {
+	list := xattr.List
+	get := xattr.Get
+	set := xattr.Set
+	if symlink {
+		list = xattr.LList
+		get = xattr.LGet
+		set = xattr.LSet
+	}
+
+	names, err := list(srcPath)
+	if err != nil {
+		return xerrors.Errorf("failed to list xattrs for %s: %w", srcPath, err)
+	}
+
+	for _, name := range names {
+		if strings.HasPrefix(name, "trusted.overlay.") {
+			continue
+		}
+
+		val, err := get(srcPath, name)
+		if err != nil {
+			return xerrors.Errorf("failed to get xattr %s for %s: %w", name, srcPath, err)
+		}
+
+		if err := set(destPath, name, val); err != nil {
+			return xerrors.Errorf("failed to set xattr %s on %s: %w", name, destPath, err)
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,258 @@
+package syncher
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/xattr"
+	"golang.org/x/sys/unix"
+)
+
+func TestApplyMetadataPreservesSetuidSetgidSticky(t *testing.T) {
+	dir := t.TempDir()
+
+	srcPath := filepath.Join(dir, "src")
+	if err := os.WriteFile(srcPath, []byte("data"), 0o755); err != nil {
+		t.Fatalf("failed to create src file: %s", err)
+	}
+
+	srcMode := os.FileMode(0o4755) | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	if err := os.Chmod(srcPath, srcMode); err != nil {
+		t.Fatalf("failed to chmod src file: %s", err)
+	}
+
+	destPath := filepath.Join(dir, "dest")
+	if err := os.WriteFile(destPath, []byte("data"), 0o644); err != nil {
+		t.Fatalf("failed to create dest file: %s", err)
+	}
+
+	syncher := &OverlayFSSyncher{}
+	if err := syncher.applyMetadata(srcPath, destPath); err != nil {
+		t.Fatalf("applyMetadata failed: %s", err)
+	}
+
+	srcInfo, err := os.Stat(srcPath)
+	if err != nil {
+		t.Fatalf("failed to stat src file: %s", err)
+	}
+
+	destInfo, err := os.Stat(destPath)
+	if err != nil {
+		t.Fatalf("failed to stat dest file: %s", err)
+	}
+
+	if destInfo.Mode() != srcInfo.Mode() {
+		t.Fatalf("expected dest mode %s to match src mode %s", destInfo.Mode(), srcInfo.Mode())
+	}
+
+	if destInfo.Mode()&os.ModeSetuid == 0 {
+		t.Fatalf("expected setuid bit to be preserved, got mode %s", destInfo.Mode())
+	}
+
+	if destInfo.Mode()&os.ModeSetgid == 0 {
+		t.Fatalf("expected setgid bit to be preserved, got mode %s", destInfo.Mode())
+	}
+
+	if destInfo.Mode()&os.ModeSticky == 0 {
+		t.Fatalf("expected sticky bit to be preserved, got mode %s", destInfo.Mode())
+	}
+}
+
+func TestSyncDevicePreservesMajorMinor(t *testing.T) {
+	upper := t.TempDir()
+	lower := t.TempDir()
+
+	devPath := filepath.Join(upper, "dev0")
+	// major 1, minor 5 is /dev/zero on Linux; any real (non 0/0) rdev
+	// exercises the fix.
+	if err := syscall.Mknod(devPath, syscall.S_IFCHR|0o644, int(unix.Mkdev(1, 5))); err != nil {
+		t.Skipf("mknod not permitted in this environment: %s", err)
+	}
+
+	syncher, err := NewOverlayFSSyncher(lower, upper)
+	if err != nil {
+		t.Fatalf("failed to create syncher: %s", err)
+	}
+
+	if err := syncher.syncDevice(devPath); err != nil {
+		t.Fatalf("syncDevice failed: %s", err)
+	}
+
+	lowerPath := filepath.Join(lower, "dev0")
+	lowerInfo, err := os.Lstat(lowerPath)
+	if err != nil {
+		t.Fatalf("expected device node to be created on the lower layer: %s", err)
+	}
+
+	if lowerInfo.Mode()&os.ModeCharDevice == 0 {
+		t.Fatalf("expected a char device node, got mode %s", lowerInfo.Mode())
+	}
+
+	lowerStat, ok := lowerInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		t.Fatalf("failed to get stat_t for %s", lowerPath)
+	}
+
+	if unix.Major(uint64(lowerStat.Rdev)) != 1 || unix.Minor(uint64(lowerStat.Rdev)) != 5 {
+		t.Fatalf("expected major/minor 1/5, got %d/%d", unix.Major(uint64(lowerStat.Rdev)), unix.Minor(uint64(lowerStat.Rdev)))
+	}
+}
+
+func TestSyncRecreatesBlockDeviceInsteadOfCopyingAsFile(t *testing.T) {
+	upper := t.TempDir()
+	lower := t.TempDir()
+
+	devPath := filepath.Join(upper, "loop0")
+	if err := syscall.Mknod(devPath, syscall.S_IFBLK|0o644, int(unix.Mkdev(7, 0))); err != nil {
+		t.Skipf("mknod not permitted in this environment: %s", err)
+	}
+
+	syncher, err := NewOverlayFSSyncher(lower, upper)
+	if err != nil {
+		t.Fatalf("failed to create syncher: %s", err)
+	}
+
+	if err := syncher.Sync(); err != nil {
+		t.Fatalf("Sync failed: %s", err)
+	}
+
+	lowerInfo, err := os.Lstat(filepath.Join(lower, "loop0"))
+	if err != nil {
+		t.Fatalf("expected block device node to be created on the lower layer: %s", err)
+	}
+
+	if lowerInfo.Mode()&os.ModeDevice == 0 || lowerInfo.Mode()&os.ModeCharDevice != 0 {
+		t.Fatalf("expected a block device node, got mode %s", lowerInfo.Mode())
+	}
+}
+
+func TestSyncDirMovesRedirectedDirToNewName(t *testing.T) {
+	upper := t.TempDir()
+	lower := t.TempDir()
+
+	oldLowerDir := filepath.Join(lower, "oldname")
+	if err := os.MkdirAll(oldLowerDir, 0o755); err != nil {
+		t.Fatalf("failed to create lower dir: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(oldLowerDir, "file.txt"), []byte("data"), 0o644); err != nil {
+		t.Fatalf("failed to create file in lower dir: %s", err)
+	}
+
+	upperDir := filepath.Join(upper, "newname")
+	if err := os.MkdirAll(upperDir, 0o755); err != nil {
+		t.Fatalf("failed to create upper dir: %s", err)
+	}
+	if err := xattr.Set(upperDir, overlayFSRedirectXAttr, []byte("/oldname")); err != nil {
+		t.Skipf("trusted xattrs not permitted in this environment: %s", err)
+	}
+
+	syncher, err := NewOverlayFSSyncher(lower, upper)
+	if err != nil {
+		t.Fatalf("failed to create syncher: %s", err)
+	}
+
+	if err := syncher.syncDir(upperDir); err != nil {
+		t.Fatalf("syncDir failed: %s", err)
+	}
+
+	newLowerDir := filepath.Join(lower, "newname")
+	data, err := os.ReadFile(filepath.Join(newLowerDir, "file.txt"))
+	if err != nil {
+		t.Fatalf("expected redirected dir contents to be moved to %s: %s", newLowerDir, err)
+	}
+	if string(data) != "data" {
+		t.Fatalf("expected file.txt contents to survive the move, got %q", data)
+	}
+
+	if _, err := os.Lstat(oldLowerDir); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to no longer exist after the redirect move", oldLowerDir)
+	}
+}
+
+func TestSyncFileMetacopyZeroSizeUpdatesMetadataOnly(t *testing.T) {
+	upper := t.TempDir()
+	lower := t.TempDir()
+
+	lowerPath := filepath.Join(lower, "file")
+	if err := os.WriteFile(lowerPath, []byte("real content lives here"), 0o644); err != nil {
+		t.Fatalf("failed to create lower file: %s", err)
+	}
+
+	upperPath := filepath.Join(upper, "file")
+	if err := os.WriteFile(upperPath, nil, 0o640); err != nil {
+		t.Fatalf("failed to create upper file: %s", err)
+	}
+	if err := xattr.Set(upperPath, overlayFSMetacopyXAttr, []byte{}); err != nil {
+		t.Skipf("trusted xattrs not permitted in this environment: %s", err)
+	}
+
+	syncher, err := NewOverlayFSSyncher(lower, upper)
+	if err != nil {
+		t.Fatalf("failed to create syncher: %s", err)
+	}
+
+	if err := syncher.syncFile(upperPath, false); err != nil {
+		t.Fatalf("syncFile failed: %s", err)
+	}
+
+	data, err := os.ReadFile(lowerPath)
+	if err != nil {
+		t.Fatalf("failed to read lower file: %s", err)
+	}
+	if string(data) != "real content lives here" {
+		t.Fatalf("expected metacopy sync to leave lower content untouched, got %q", data)
+	}
+
+	lowerInfo, err := os.Stat(lowerPath)
+	if err != nil {
+		t.Fatalf("failed to stat lower file: %s", err)
+	}
+	if lowerInfo.Mode().Perm() != 0o640 {
+		t.Fatalf("expected metacopy sync to apply upper's mode, got %s", lowerInfo.Mode())
+	}
+}
+
+func TestSyncConcurrentCopiesAllFilesCorrectly(t *testing.T) {
+	upper := t.TempDir()
+	lower := t.TempDir()
+
+	const numFiles = 40
+	for i := 0; i < numFiles; i++ {
+		dir := filepath.Join(upper, fmt.Sprintf("dir%d", i%5))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("failed to create upper dir: %s", err)
+		}
+
+		content := bytes.Repeat([]byte{byte(i)}, 4096)
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), content, 0o644); err != nil {
+			t.Fatalf("failed to create upper file: %s", err)
+		}
+	}
+
+	syncher, err := NewOverlayFSSyncher(lower, upper)
+	if err != nil {
+		t.Fatalf("failed to create syncher: %s", err)
+	}
+	syncher.SetConcurrency(8)
+
+	if err := syncher.Sync(); err != nil {
+		t.Fatalf("Sync failed: %s", err)
+	}
+
+	for i := 0; i < numFiles; i++ {
+		path := filepath.Join(lower, fmt.Sprintf("dir%d", i%5), fmt.Sprintf("file%d", i))
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("expected %s to be synced to the lower layer: %s", path, err)
+		}
+
+		want := bytes.Repeat([]byte{byte(i)}, 4096)
+		if !bytes.Equal(data, want) {
+			t.Fatalf("expected %s to have the correct contents after a concurrent sync", path)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package syncher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// maxSymlinkDepth bounds how many symlinks secureJoin will resolve while
+// walking a path, guarding against symlink loops.
+const maxSymlinkDepth = 255
+
+// secureJoin joins root and unsafePath the way cyphar/filepath-securejoin
+// does: it walks unsafePath component by component under root, and
+// whenever a component turns out to be a symlink, it re-anchors the
+// symlink's target at root instead of letting it resolve against the real
+// filesystem root. This guarantees the result can never escape root, even
+// if unsafePath (or a symlink discovered along the way) contains ".." or
+// is itself absolute.
+func secureJoin(root string, unsafePath string) (string, error) {
+	remaining := filepath.ToSlash(unsafePath)
+	resolved := ""
+	depth := 0
+
+	for remaining != "" {
+		var component string
+		if idx := strings.IndexByte(remaining, '/'); idx >= 0 {
+			component, remaining = remaining[:idx], remaining[idx+1:]
+		} else {
+			component, remaining = remaining, ""
+		}
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			if resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+
+		candidate := filepath.Join(resolved, component)
+		fullCandidate := filepath.Join(root, candidate)
+
+		info, err := os.Lstat(fullCandidate)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// the rest of the path doesn't exist yet (e.g. we're
+				// computing a destination path that's about to be
+				// created); nothing left to resolve safely.
+				resolved = candidate
+				continue
+			}
+
+			return "", xerrors.Errorf("failed to lstat %s: %w", fullCandidate, err)
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = candidate
+			continue
+		}
+
+		depth++
+		if depth > maxSymlinkDepth {
+			return "", xerrors.Errorf("exceeded max symlink depth (%d) resolving %s under %s", maxSymlinkDepth, unsafePath, root)
+		}
+
+		target, err := os.Readlink(fullCandidate)
+		if err != nil {
+			return "", xerrors.Errorf("failed to readlink %s: %w", fullCandidate, err)
+		}
+
+		if filepath.IsAbs(target) {
+			// an absolute symlink target is rooted at root, not at the
+			// real filesystem root, so drop everything resolved so far
+			resolved = ""
+		}
+
+		remaining = filepath.ToSlash(target) + "/" + remaining
+	}
+
+	return filepath.Join(root, resolved), nil
+}
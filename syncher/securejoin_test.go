@@ -0,0 +1,77 @@
+package syncher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecureJoinRejectsAbsoluteSymlinkEscape(t *testing.T) {
+	root := t.TempDir()
+
+	if err := os.Symlink("/etc", filepath.Join(root, "link")); err != nil {
+		t.Fatalf("failed to create symlink: %s", err)
+	}
+
+	got, err := secureJoin(root, filepath.Join("link", "passwd"))
+	if err != nil {
+		t.Fatalf("secureJoin failed: %s", err)
+	}
+
+	want := filepath.Join(root, "etc", "passwd")
+	if got != want {
+		t.Fatalf("expected symlink to /etc to be re-rooted at %s, got %s", want, got)
+	}
+}
+
+func TestSecureJoinRejectsDotDotSymlinkEscape(t *testing.T) {
+	root := t.TempDir()
+
+	if err := os.Symlink("../../..", filepath.Join(root, "link")); err != nil {
+		t.Fatalf("failed to create symlink: %s", err)
+	}
+
+	got, err := secureJoin(root, filepath.Join("link", "passwd"))
+	if err != nil {
+		t.Fatalf("secureJoin failed: %s", err)
+	}
+
+	want := filepath.Join(root, "passwd")
+	if got != want {
+		t.Fatalf("expected ../.. symlink to be clamped to %s, got %s", want, got)
+	}
+}
+
+func TestSecureJoinDetectsSymlinkLoop(t *testing.T) {
+	root := t.TempDir()
+
+	if err := os.Symlink("b", filepath.Join(root, "a")); err != nil {
+		t.Fatalf("failed to create symlink a: %s", err)
+	}
+	if err := os.Symlink("a", filepath.Join(root, "b")); err != nil {
+		t.Fatalf("failed to create symlink b: %s", err)
+	}
+
+	_, err := secureJoin(root, filepath.Join("a", "file"))
+	if err == nil {
+		t.Fatalf("expected secureJoin to fail on a symlink loop")
+	}
+}
+
+func TestSecureJoinPlainPath(t *testing.T) {
+	root := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0o755); err != nil {
+		t.Fatalf("failed to create dirs: %s", err)
+	}
+
+	got, err := secureJoin(root, filepath.Join("a", "b", "c"))
+	if err != nil {
+		t.Fatalf("secureJoin failed: %s", err)
+	}
+
+	want := filepath.Join(root, "a", "b", "c")
+	if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}